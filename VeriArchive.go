@@ -1,34 +1,60 @@
 package main
 
 import (
-	"archive/zip"
-	"bytes"
-	"crypto/md5"
-	"crypto/sha1"
-	"crypto/sha256"
 	"flag"
 	"fmt"
-	"hash"
-	"hash/fnv"
 	"io"
 	"os"
-	"path/filepath"
-	"strings"
+	"runtime"
 	"time"
 )
 
 func main() {
 	dir := flag.String("dir", "", "Folder full path")
 	output := flag.String("o", "", "Output archive file")
-	hashAlgo := flag.String("hash", "", "Hashing algorithm (sha256, fnv1a, sha1, md5)")
-	checksumFile := flag.String("checksum", "checksum.txt", "Checksum file name")
+	hashAlgo := flag.String("hash", "", "Hashing algorithm (any name registered via RegisterHasher, e.g. sha256, sha3-256, shake256, blake2b, crc32, ripemd160)")
+	manifestFile := flag.String("manifest", "MANIFEST", "Manifest file name")
+	signKeyFile := flag.String("sign", "", "PGP keyfile: private key to sign the manifest on creation, public key to verify it on -verify")
+	hmacKey := flag.String("hmac-key", "", "HMAC key; when set, -hash is computed as HMAC-<hash> keyed with this value")
+	jobs := flag.Int("j", runtime.NumCPU(), "Number of parallel compression/hashing workers")
+	incremental := flag.Bool("incremental", false, "Only archive files changed since the last run, tracked in -db")
+	dbPath := flag.String("db", "veriarchive.db.json", "Incremental manifest database path")
+	apply := flag.Bool("apply", false, "Reconstruct current state from a base archive (-o) plus one or more delta archives (trailing args)")
 	verify := flag.Bool("verify", false, "Verify archive integrity (<dir> and <hash> are ignored))")
+	encryptAlgo := flag.String("encrypt", "", "Encrypt each entry with WinZip AE-2 (aes128, aes192, aes256)")
+	passwordFlag := flag.String("password", "", "Passphrase for -encrypt/decryption; falls back to VERIARCHIVE_PASSWORD")
 
 	flag.Parse()
 
-	// Verify the integrity of the archive if the verify flag is set
-	if *output != "" && *hashAlgo != "" && *verify {
-		verifyChecksum(*output, *hashAlgo, *checksumFile)
+	password := *passwordFlag
+	if password == "" {
+		password = os.Getenv("VERIARCHIVE_PASSWORD")
+	}
+
+	// Reconstruct a base archive plus its deltas into a single archive.
+	if *apply {
+		deltas := flag.Args()
+		if *output == "" || len(deltas) == 0 {
+			flag.Usage()
+			return
+		}
+		if err := checkFilesReadability(*output, password, deltas...); err != nil {
+			fmt.Println("\nChain readability check failed:", err)
+			return
+		}
+		reconstructed := *output + ".reconstructed.zip"
+		if err := applyDeltas(*output, deltas, reconstructed, password); err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Println("Reconstructed archive:", reconstructed)
+		return
+	}
+
+	// Verify the integrity of the archive if the verify flag is set. The
+	// hashing algorithm is auto-detected from the manifest itself.
+	if *output != "" && *verify {
+		verifyArchive(*output, *manifestFile, *signKeyFile, []byte(*hmacKey), password)
 		return
 	}
 
@@ -38,17 +64,33 @@ func main() {
 		return
 	}
 
-	hasher, err := getHasher(*hashAlgo)
+	archiver, err := NewArchiver(*hashAlgo, []byte(*hmacKey), *jobs)
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
+	if *encryptAlgo != "" {
+		if password == "" {
+			fmt.Println("error: -encrypt requires -password or VERIARCHIVE_PASSWORD")
+			return
+		}
+		if err := archiver.WithEncryption(*encryptAlgo, password); err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
 	// start the timer
 	start := time.Now()
 
 	go displayLoadingScreen()
 
-	err = createZipArchive(*dir, *output, hasher)
+	archivePath := *output
+	var entries []ManifestEntry
+	if *incremental {
+		archivePath, entries, err = buildIncrementalArchive(*dir, *output, *dbPath, archiver)
+	} else {
+		entries, err = archiver.Archive(*dir, *output)
+	}
 	if err != nil {
 		fmt.Println(err)
 		return
@@ -56,9 +98,9 @@ func main() {
 	// stop the timer
 	elapsed := time.Since(start)
 	//print the archive name
-	fmt.Println("\nArchive name:", *output)
+	fmt.Println("\nArchive name:", archivePath)
 	//print the archive size
-	archiveSize, err := getFileSize(*output)
+	archiveSize, err := getFileSize(archivePath)
 	if err != nil {
 		fmt.Println("Failed to get the archive size:", err)
 		return
@@ -66,7 +108,7 @@ func main() {
 	//print the archive size in a human readable format
 	fmt.Println("Archive size:", humanReadableSize(archiveSize))
 
-	err = checkFilesReadability(*output)
+	err = checkFilesReadability(archivePath, password)
 	if err != nil {
 		fmt.Println("\nFailed to read the files in the archive:", err)
 		return
@@ -76,94 +118,34 @@ func main() {
 	fmt.Printf("Time start: %s\n", start.Format(time.RFC3339))
 	fmt.Printf("Elapsed time: %s\n", elapsed)
 	fmt.Println("Completed.")
-	hashValue := hasher.Sum(nil)
-	fmt.Printf("\033[33mHash (%s) : %x\033[0m\n", *hashAlgo, hashValue)
-	writeChecksum(*hashAlgo, hashValue, *checksumFile)
-	fmt.Println("Checksum file:", *checksumFile)
-	// convert the hash value to a string
-	hashValueString := fmt.Sprintf("%x", hashValue)
-	//save a log file with the archive name, size, hash time start and elapsed time as a csv file
-	saveLog(*output, humanReadableSize(archiveSize), *hashAlgo, hashValueString, start, elapsed)
-
-}
-
-func getHasher(hashAlgo string) (hash.Hash, error) {
-	switch hashAlgo {
-	case "sha256":
-		return sha256.New(), nil
-	case "fnv1a":
-		return fnv.New64a(), nil
-	case "sha1":
-		return sha1.New(), nil
-	case "md5":
-		return md5.New(), nil
-	default:
-		return nil, fmt.Errorf("invalid hashing algorithm")
-	}
-}
-
-func createZipArchive(dir, output string, hasher hash.Hash) error {
-	zipFile, err := os.Create(output)
-	if err != nil {
-		return err
+	hashValue := archiver.ArchiveHash()
+	contentHash := archiver.ContentHash()
+	// tarsum ignores -hmac-key entirely (see compressFile), so its label
+	// never carries the hmac- prefix the way a normal -hash does.
+	fileLabel := *hashAlgo
+	if *hashAlgo != tarsumAlgoName {
+		fileLabel = hashLabel(*hashAlgo, []byte(*hmacKey))
+	}
+	archiveLabel := archiver.archiveHashLabel()
+	fmt.Printf("\033[33mHash (%s) : %x\033[0m\n", archiveLabel, hashValue)
+	fmt.Printf("\033[33mTarsum (content hash) : %x\033[0m\n", contentHash)
+	if err := writeManifest(*manifestFile, fileLabel, archiveLabel, entries, hashValue, contentHash); err != nil {
+		fmt.Println(err)
+		return
 	}
-	defer zipFile.Close()
-
-	zipWriter := zip.NewWriter(zipFile)
-	//defer zipWriter.Close()
-
-	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-
-		if info.IsDir() {
-			return nil
-		}
-
-		relPath, err := filepath.Rel(dir, path)
-		if err != nil {
-			return err
+	fmt.Println("Manifest file:", *manifestFile)
+	if *signKeyFile != "" {
+		if err := signManifest(*manifestFile, *signKeyFile); err != nil {
+			fmt.Println(err)
+			return
 		}
-
-		header, err := zip.FileInfoHeader(info)
-		if err != nil {
-			return err
-		}
-
-		header.Name = relPath
-		header.Method = zip.Deflate
-
-		writer, err := zipWriter.CreateHeader(header)
-		if err != nil {
-			return err
-		}
-
-		file, err := os.Open(path)
-		if err != nil {
-			return err
-		}
-		defer file.Close()
-
-		_, err = io.Copy(writer, file)
-		return err
-	})
-
-	if err != nil {
-		return err
+		fmt.Println("Manifest signature:", *manifestFile+manifestSigExt)
 	}
+	// convert the hash value to a string
+	hashValueString := fmt.Sprintf("%x", hashValue)
+	//save a log file with the archive name, size, hash time start and elapsed time as a csv file
+	saveLog(archivePath, humanReadableSize(archiveSize), *hashAlgo, hashValueString, start, elapsed)
 
-	zipWriter.Close()
-
-	_, err = zipFile.Seek(0, io.SeekStart)
-	if err != nil {
-		return err
-	}
-	_, err = io.Copy(hasher, zipFile)
-	if err != nil {
-		return err
-	}
-	return nil
 }
 
 func displayLoadingScreen() {
@@ -173,89 +155,59 @@ func displayLoadingScreen() {
 	}
 }
 
-func writeChecksum(hashAlgo string, hashValue []byte, checksumFile string) {
-	file, err := os.Create(checksumFile)
-	if err != nil {
-		fmt.Printf("Error creating checksum file: %v\n", err)
-		return
-	}
-	defer file.Close()
-	// Write the checksum to the file using a compatible checksum format
-	_, err = fmt.Fprintf(file, "%s %x", strings.ToUpper(hashAlgo), hashValue)
-	if err != nil {
-		fmt.Printf("Error writing checksum to file: %v\n", err)
-		return
-	}
-}
-
-func verifyChecksum(archive, hashAlgo, checksumFile string) {
-	hasher, err := getHasher(hashAlgo)
-	if err != nil {
-		fmt.Println(err)
-		return
-	}
-
-	file, err := os.Open(archive)
-	if err != nil {
-		fmt.Println(err)
-		return
-	}
-	defer file.Close()
-
-	_, err = io.Copy(hasher, file)
-	if err != nil {
-		fmt.Println(err)
-		return
-	}
-
-	hashValue := hasher.Sum(nil)
-	fmt.Printf("\033[33mComputed Hash (%s): %x\033[0m", hashAlgo, hashValue)
-
-	file, err = os.Open(checksumFile)
-	if err != nil {
-		fmt.Println(err)
-		return
+// verifyArchive checks a MANIFEST (and, if a keyfile was supplied, its
+// detached signature) against an archive, re-hashing each member
+// individually so corruption can be pinned to the offending file rather
+// than just failing verification outright.
+func verifyArchive(archive, manifestFile, signKeyFile string, hmacKey []byte, password string) {
+	if signKeyFile != "" {
+		if err := verifyManifestSignature(manifestFile, signKeyFile); err != nil {
+			fmt.Printf(" \033[31m%v\033[0m\n", err)
+			return
+		}
+		fmt.Println("\033[32mManifest signature verified\033[0m")
 	}
-	defer file.Close()
 
-	var checksumHash string
-	var readHash []byte
-	_, err = fmt.Fscanf(file, "%s %x", &checksumHash, &readHash)
+	mismatches, err := verifyManifest(archive, manifestFile, hmacKey, password)
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
 
-	if checksumHash != strings.ToUpper(hashAlgo) {
-		fmt.Println(" \033[31mHashing algorithm mismatch\033[0m")
+	if len(mismatches) == 0 {
+		fmt.Println("\033[32mAll files verified against manifest\033[0m")
 		return
 	}
 
-	if !bytes.Equal(hashValue, readHash) {
-		fmt.Printf(" \033[31mHash mismatch: computed: %x, read: %x\033[0m\n", hashValue, readHash)
-		return
+	fmt.Printf("\033[31m%d file(s) failed verification:\033[0m\n", len(mismatches))
+	for _, m := range mismatches {
+		fmt.Printf("  \033[31m%s: %s\033[0m\n", m.Path, m.Reason)
 	}
-
-	fmt.Println(" \033[32mChecksum verified\033[0m")
 }
 
-func checkFilesReadability(archive string) error {
-	zipReader, err := zip.OpenReader(archive)
+// checkFilesReadability verifies every file can be read back out of
+// archive, transparently decrypting AES-encrypted entries with
+// password. Passing deltas traverses the full incremental chain
+// (archive as the base, deltas applied in order) instead of a single
+// zip.
+func checkFilesReadability(archive, password string, deltas ...string) error {
+	current, closers, err := resolveChain(archive, deltas)
 	if err != nil {
+		closeAll(closers)
 		return err
 	}
-	defer zipReader.Close()
+	defer closeAll(closers)
 
-	for _, file := range zipReader.File {
-		fileReader, err := file.Open()
+	for name, file := range current {
+		fileReader, err := openEntry(file, password)
 		if err != nil {
-			return fmt.Errorf("failed to open file %s: %v", file.Name, err)
+			return fmt.Errorf("failed to open file %s: %v", name, err)
 		}
-		defer fileReader.Close()
 
 		_, err = io.Copy(io.Discard, fileReader)
+		fileReader.Close()
 		if err != nil {
-			return fmt.Errorf("failed to read file %s: %v", file.Name, err)
+			return fmt.Errorf("failed to read file %s: %v", name, err)
 		}
 	}
 
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEncryptDecryptEntryRoundTrip(t *testing.T) {
+	for name := range aesKeySpecs {
+		spec, err := aesSpecByName(name)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		plaintext := []byte("the quick brown fox jumps over the lazy dog")
+		blob, err := encryptEntry(spec, "correct horse", plaintext)
+		if err != nil {
+			t.Fatalf("%s: encryptEntry: %v", name, err)
+		}
+
+		got, err := decryptEntry(spec, "correct horse", blob)
+		if err != nil {
+			t.Fatalf("%s: decryptEntry: %v", name, err)
+		}
+		if !bytes.Equal(got, plaintext) {
+			t.Fatalf("%s: round trip produced %q, want %q", name, got, plaintext)
+		}
+	}
+}
+
+func TestDecryptEntryWrongPassword(t *testing.T) {
+	spec, err := aesSpecByName("aes256")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blob, err := encryptEntry(spec, "right", []byte("secret payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := decryptEntry(spec, "wrong", blob); err == nil {
+		t.Fatal("expected decryptEntry to fail the auth tag check with the wrong password")
+	}
+}
+
+func TestDecryptEntryTamperedCiphertext(t *testing.T) {
+	spec, err := aesSpecByName("aes128")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blob, err := encryptEntry(spec, "pw", []byte("secret payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob[len(blob)-1] ^= 0xFF // flip a bit in the auth tag
+
+	if _, err := decryptEntry(spec, "pw", blob); err == nil {
+		t.Fatal("expected decryptEntry to reject a tampered blob")
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestResolveHasherRoundTrip(t *testing.T) {
+	for _, algo := range []string{"sha256", "blake2b", "ripemd160", "crc32"} {
+		h, err := getHasher(algo)
+		if err != nil {
+			t.Fatalf("%s: %v", algo, err)
+		}
+		h.Write([]byte("payload"))
+		want := h.Sum(nil)
+
+		// MANIFEST files record the label uppercased; resolveHasher must
+		// accept that back, not just the lowercase registry key.
+		got, err := resolveHasher(hashLabel(algo, nil), nil)
+		if err != nil {
+			t.Fatalf("%s: resolveHasher: %v", algo, err)
+		}
+		got.Write([]byte("payload"))
+		if !bytes.Equal(got.Sum(nil), want) {
+			t.Fatalf("%s: resolveHasher produced a different digest", algo)
+		}
+	}
+}
+
+func TestResolveHasherHMAC(t *testing.T) {
+	key := []byte("key")
+	label := hashLabel("sha256", key)
+	if label != "hmac-sha256" {
+		t.Fatalf("label = %q, want hmac-sha256", label)
+	}
+
+	want, err := getHMACHasher("sha256", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want.Write([]byte("payload"))
+
+	got, err := resolveHasher(label, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got.Write([]byte("payload"))
+
+	if !bytes.Equal(got.Sum(nil), want.Sum(nil)) {
+		t.Fatal("resolveHasher(hmac label) produced a different digest than getHMACHasher")
+	}
+
+	if _, err := resolveHasher(label, nil); err == nil {
+		t.Fatal("expected an error resolving an HMAC label without a key")
+	}
+}
+
+func TestResolveHasherUnknownAlgo(t *testing.T) {
+	if _, err := getHasher("not-a-real-algo"); err == nil {
+		t.Fatal("expected an error for an unregistered algorithm")
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+// deltaSuffix is appended to -o to name the zip produced by an
+// incremental run; tombstoneSuffix names its companion deletion list.
+const (
+	deltaSuffix     = ".delta.zip"
+	tombstoneSuffix = ".tombstones.json"
+)
+
+// DBEntry records a file's last-known state as of the run that archived
+// it, keyed by its relative path in IncrementalDB.Files.
+type DBEntry struct {
+	Size    int64     `json:"size"`
+	MTime   time.Time `json:"mtime"`
+	Hash    string    `json:"hash"`
+	Deleted bool      `json:"deleted,omitempty"`
+}
+
+// IncrementalDB is the JSON manifest database that -incremental
+// consults to decide which files are new or changed since the last run.
+type IncrementalDB struct {
+	Files map[string]DBEntry `json:"files"`
+}
+
+// loadDB reads the database at path, returning a fresh empty one if it
+// doesn't exist yet (the first -incremental run against a tree).
+func loadDB(path string) (*IncrementalDB, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &IncrementalDB{Files: map[string]DBEntry{}}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var db IncrementalDB
+	if err := json.Unmarshal(data, &db); err != nil {
+		return nil, fmt.Errorf("malformed incremental database %s: %w", path, err)
+	}
+	if db.Files == nil {
+		db.Files = map[string]DBEntry{}
+	}
+	return &db, nil
+}
+
+func (db *IncrementalDB) save(path string) error {
+	data, err := json.MarshalIndent(db, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// mtimeSlack bounds how far apart two modification times can be and
+// still be considered the same: zip's legacy DOS timestamp field only
+// has 2-second resolution and always rounds down, so a database seeded
+// from an existing archive (see seedDBFromArchive) can read back up to
+// 2 seconds earlier than the filesystem's own mtime for the same file.
+const mtimeSlack = 2 * time.Second
+
+// changedFiles walks dir and splits it against db into the files that
+// are new or modified (and so belong in the next delta) and the paths
+// previously recorded but now missing from disk.
+func changedFiles(dir string, db *IncrementalDB) (changed []fileJob, deleted []string, err error) {
+	jobs, err := discoverFiles(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	seen := make(map[string]bool, len(jobs))
+	for _, job := range jobs {
+		seen[job.relPath] = true
+		prev, ok := db.Files[job.relPath]
+		if !ok || prev.Deleted || prev.Size != job.info.Size() || mtimeDiff(prev.MTime, job.info.ModTime()) > mtimeSlack {
+			changed = append(changed, job)
+		}
+	}
+
+	for path, prev := range db.Files {
+		if !prev.Deleted && !seen[path] {
+			deleted = append(deleted, path)
+		}
+	}
+	sort.Strings(deleted)
+
+	return reindexJobs(changed), deleted, nil
+}
+
+func mtimeDiff(a, b time.Time) time.Duration {
+	d := a.Sub(b)
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+// buildIncrementalArchive compares dir against the database at dbPath
+// and archives only the new/changed files, recording any deletions in a
+// tombstone side file and updating the database with the new state.
+//
+// The very first -incremental run against a tree (no database yet) has
+// nothing to diff against, so it writes a real base archive at the
+// literal output path instead of a delta — giving -apply a base it can
+// actually find. If output already exists at that point (e.g. a plain,
+// non-incremental run produced it earlier), the fresh database is
+// seeded from that archive's contents instead, so the next run diffs
+// against it rather than re-including every unchanged file.
+func buildIncrementalArchive(dir, output, dbPath string, archiver *Archiver) (string, []ManifestEntry, error) {
+	_, statErr := os.Stat(dbPath)
+	dbExisted := statErr == nil
+	if statErr != nil && !os.IsNotExist(statErr) {
+		return "", nil, statErr
+	}
+
+	db, err := loadDB(dbPath)
+	if err != nil {
+		return "", nil, err
+	}
+
+	archivePath := output + deltaSuffix
+	if !dbExisted {
+		seeded, err := seedDBFromArchive(db, output)
+		if err != nil {
+			return "", nil, err
+		}
+		if !seeded {
+			archivePath = output
+		}
+	}
+
+	changed, deleted, err := changedFiles(dir, db)
+	if err != nil {
+		return "", nil, err
+	}
+
+	entries, err := archiver.archiveJobs(changed, archivePath)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if len(deleted) > 0 {
+		data, err := json.MarshalIndent(deleted, "", "  ")
+		if err != nil {
+			return "", nil, err
+		}
+		if err := os.WriteFile(archivePath+tombstoneSuffix, data, 0644); err != nil {
+			return "", nil, err
+		}
+	}
+
+	for _, e := range entries {
+		db.Files[e.Path] = DBEntry{Size: e.Size, MTime: e.MTime, Hash: e.Hash}
+	}
+	for _, path := range deleted {
+		db.Files[path] = DBEntry{Deleted: true}
+	}
+	if err := db.save(dbPath); err != nil {
+		return "", nil, err
+	}
+
+	return archivePath, entries, nil
+}
+
+// seedDBFromArchive seeds a fresh incremental database from an archive
+// that already exists at output, so switching a tree to -incremental
+// after an earlier plain run diffs against what's already archived
+// instead of treating every file as new. Returns false if output
+// doesn't exist yet (a from-scratch first run).
+func seedDBFromArchive(db *IncrementalDB, output string) (bool, error) {
+	r, err := zip.OpenReader(output)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer r.Close()
+
+	for _, f := range r.File {
+		db.Files[f.Name] = DBEntry{Size: int64(f.UncompressedSize64), MTime: f.Modified}
+	}
+	return true, nil
+}
+
+// resolveChain replays a base archive plus zero or more deltas (each
+// produced by buildIncrementalArchive, applied in order) and returns
+// the resulting view as a path -> zip.File map. The returned closers
+// must be closed by the caller once it is done reading from the files.
+func resolveChain(base string, deltas []string) (map[string]*zip.File, []io.Closer, error) {
+	current := map[string]*zip.File{}
+	var closers []io.Closer
+
+	apply := func(archive string) error {
+		r, err := zip.OpenReader(archive)
+		if err != nil {
+			return fmt.Errorf("opening %s: %w", archive, err)
+		}
+		closers = append(closers, r)
+		for _, f := range r.File {
+			current[f.Name] = f
+		}
+		return nil
+	}
+
+	if err := apply(base); err != nil {
+		return nil, closers, err
+	}
+
+	for _, delta := range deltas {
+		if err := apply(delta); err != nil {
+			return nil, closers, err
+		}
+
+		tombstones, err := readTombstones(delta + tombstoneSuffix)
+		if err != nil {
+			return nil, closers, err
+		}
+		for _, path := range tombstones {
+			delete(current, path)
+		}
+	}
+
+	return current, closers, nil
+}
+
+func readTombstones(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	if err := json.Unmarshal(data, &paths); err != nil {
+		return nil, fmt.Errorf("malformed tombstone file %s: %w", path, err)
+	}
+	return paths, nil
+}
+
+func closeAll(closers []io.Closer) {
+	for _, c := range closers {
+		c.Close()
+	}
+}
+
+// applyDeltas reconstructs the current state of base plus deltas
+// (applied in order) into a single new zip at output. Any AES-encrypted
+// source entries are decrypted with password and written back out
+// unencrypted.
+func applyDeltas(base string, deltas []string, output, password string) error {
+	current, closers, err := resolveChain(base, deltas)
+	if err != nil {
+		closeAll(closers)
+		return err
+	}
+	defer closeAll(closers)
+
+	names := make([]string, 0, len(current))
+	for name := range current {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	out, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	zipWriter := zip.NewWriter(out)
+	for _, name := range names {
+		f := current[name]
+		hdr := f.FileHeader
+		hdr.Method = zip.Deflate
+		hdr.Extra = nil
+		writer, err := zipWriter.CreateHeader(&hdr)
+		if err != nil {
+			return err
+		}
+		rc, err := openEntry(f, password)
+		if err != nil {
+			return fmt.Errorf("opening %s: %w", name, err)
+		}
+		_, err = io.Copy(writer, rc)
+		rc.Close()
+		if err != nil {
+			return fmt.Errorf("copying %s: %w", name, err)
+		}
+	}
+	return zipWriter.Close()
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"archive/zip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func listZipNames(t *testing.T, path string) map[string]bool {
+	t.Helper()
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	names := make(map[string]bool, len(r.File))
+	for _, f := range r.File {
+		names[f.Name] = true
+	}
+	return names
+}
+
+func TestBuildIncrementalArchiveFirstRunIsABase(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("one"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	output := filepath.Join(t.TempDir(), "base.zip")
+	dbPath := filepath.Join(t.TempDir(), "db.json")
+
+	archiver, err := NewArchiver("sha256", nil, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	archivePath, _, err := buildIncrementalArchive(dir, output, dbPath, archiver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if archivePath != output {
+		t.Fatalf("first run wrote %q, want the literal output path %q", archivePath, output)
+	}
+	if _, err := os.Stat(output); err != nil {
+		t.Fatalf("expected a base archive at %s: %v", output, err)
+	}
+}
+
+func TestBuildIncrementalArchiveOnlyArchivesChangedFiles(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("one"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "b.txt"), []byte("two"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	output := filepath.Join(t.TempDir(), "base.zip")
+	dbPath := filepath.Join(t.TempDir(), "db.json")
+	archiver, err := NewArchiver("sha256", nil, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := buildIncrementalArchive(dir, output, dbPath, archiver); err != nil {
+		t.Fatal(err)
+	}
+
+	// mtimeSlack tolerates up to 2s of drift (zip's legacy timestamp
+	// resolution); sleep past it so the "changed" file is unambiguous.
+	time.Sleep(2200 * time.Millisecond)
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("one-changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	deltaPath, entries, err := buildIncrementalArchive(dir, output, dbPath, archiver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deltaPath != output+deltaSuffix {
+		t.Fatalf("second run wrote %q, want a delta at %q", deltaPath, output+deltaSuffix)
+	}
+	if len(entries) != 1 || entries[0].Path != "a.txt" {
+		t.Fatalf("delta entries = %v, want just a.txt", entries)
+	}
+
+	names := listZipNames(t, deltaPath)
+	if names["b.txt"] {
+		t.Fatal("unchanged b.txt should not be present in the delta")
+	}
+	if !names["a.txt"] {
+		t.Fatal("changed a.txt should be present in the delta")
+	}
+}
+
+// TestBuildIncrementalArchiveSeedsFromExistingBase is a regression test
+// for a bug where switching a tree to -incremental after a prior plain
+// (non-incremental) run ignored that existing archive entirely, so the
+// first incremental run re-included every unchanged file in its delta.
+func TestBuildIncrementalArchiveSeedsFromExistingBase(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("one"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "b.txt"), []byte("two"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	output := filepath.Join(t.TempDir(), "plain.zip")
+	archiver, err := NewArchiver("sha256", nil, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := archiver.Archive(dir, output); err != nil {
+		t.Fatal(err)
+	}
+
+	dbPath := filepath.Join(t.TempDir(), "db.json")
+	deltaPath, entries, err := buildIncrementalArchive(dir, output, dbPath, archiver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deltaPath != output+deltaSuffix {
+		t.Fatalf("expected a delta at %q, got %q", output+deltaSuffix, deltaPath)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("expected no changes against the seeded base, got %v", entries)
+	}
+}
+
+func TestApplyDeltasReconstructsCurrentState(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("one"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "b.txt"), []byte("two"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	output := filepath.Join(t.TempDir(), "base.zip")
+	dbPath := filepath.Join(t.TempDir(), "db.json")
+	archiver, err := NewArchiver("sha256", nil, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	basePath, _, err := buildIncrementalArchive(dir, output, dbPath, archiver)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(2200 * time.Millisecond)
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("one-changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	deltaPath, _, err := buildIncrementalArchive(dir, output, dbPath, archiver)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reconstructed := filepath.Join(t.TempDir(), "reconstructed.zip")
+	if err := applyDeltas(basePath, []string{deltaPath}, reconstructed, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := zip.OpenReader(reconstructed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	contents := make(map[string]string, len(r.File))
+	for _, f := range r.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents[f.Name] = string(buf)
+	}
+
+	if contents["a.txt"] != "one-changed" {
+		t.Fatalf("a.txt = %q, want %q", contents["a.txt"], "one-changed")
+	}
+	if contents["b.txt"] != "two" {
+		t.Fatalf("b.txt = %q, want %q", contents["b.txt"], "two")
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+// manifestSigExt is appended to the manifest file name to produce the
+// detached signature file written by signManifest.
+const manifestSigExt = ".asc"
+
+// ManifestEntry records everything VeriArchive knows about a single file
+// that was placed into the archive.
+type ManifestEntry struct {
+	Path  string
+	Size  int64
+	MTime time.Time
+	Hash  string
+}
+
+// Mismatch describes a single archive member that failed verification,
+// returned by verifyManifest so the caller can report which files are
+// corrupt instead of just failing the whole archive.
+type Mismatch struct {
+	Path   string
+	Reason string
+}
+
+// writeManifest writes the MANIFEST file: a header naming the per-file
+// hash algorithm, one line per archived file, then the archive-wide
+// hash and the tarsum content hash. The two hashes are always both
+// written, regardless of which one -hash selected, so a consumer can
+// verify either invariant.
+//
+// Format:
+//
+//	HASH <fileHashAlgo>
+//	<path>  <size>  <mtime RFC3339>  <hash>
+//	...
+//	ARCHIVE <archiveHashAlgo> <archiveHash>
+//	TARSUM <contentHash>
+func writeManifest(manifestFile, fileHashAlgo, archiveHashAlgo string, entries []ManifestEntry, archiveHash, contentHash []byte) error {
+	file, err := os.Create(manifestFile)
+	if err != nil {
+		return fmt.Errorf("error creating manifest file: %w", err)
+	}
+	defer file.Close()
+
+	sorted := make([]ManifestEntry, len(entries))
+	copy(sorted, entries)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Path < sorted[j].Path })
+
+	w := bufio.NewWriter(file)
+	if _, err := fmt.Fprintf(w, "HASH %s\n", strings.ToUpper(fileHashAlgo)); err != nil {
+		return fmt.Errorf("error writing manifest header: %w", err)
+	}
+	for _, e := range sorted {
+		if _, err := fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", e.Path, e.Size, e.MTime.UTC().Format(time.RFC3339), e.Hash); err != nil {
+			return fmt.Errorf("error writing manifest entry: %w", err)
+		}
+	}
+	if _, err := fmt.Fprintf(w, "ARCHIVE %s %x\n", strings.ToUpper(archiveHashAlgo), archiveHash); err != nil {
+		return fmt.Errorf("error writing archive hash: %w", err)
+	}
+	if _, err := fmt.Fprintf(w, "TARSUM %x\n", contentHash); err != nil {
+		return fmt.Errorf("error writing tarsum: %w", err)
+	}
+	return w.Flush()
+}
+
+// readManifest parses a MANIFEST file back into its per-file entries,
+// the per-file hash algorithm used to verify them, and the trailing
+// archive-wide and tarsum content hashes.
+func readManifest(manifestFile string) (entries []ManifestEntry, fileHashAlgo string, archiveHash, contentHash []byte, err error) {
+	file, err := os.Open(manifestFile)
+	if err != nil {
+		return nil, "", nil, nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "HASH ") {
+			fileHashAlgo = strings.TrimSpace(strings.TrimPrefix(line, "HASH "))
+			continue
+		}
+		if strings.HasPrefix(line, "ARCHIVE ") {
+			fields := strings.Fields(line)
+			if len(fields) != 3 {
+				return nil, "", nil, nil, fmt.Errorf("malformed archive hash line: %q", line)
+			}
+			if _, err := fmt.Sscanf(fields[2], "%x", &archiveHash); err != nil {
+				return nil, "", nil, nil, fmt.Errorf("malformed archive hash: %w", err)
+			}
+			continue
+		}
+		if strings.HasPrefix(line, "TARSUM ") {
+			fields := strings.Fields(line)
+			if len(fields) != 2 {
+				return nil, "", nil, nil, fmt.Errorf("malformed tarsum line: %q", line)
+			}
+			if _, err := fmt.Sscanf(fields[1], "%x", &contentHash); err != nil {
+				return nil, "", nil, nil, fmt.Errorf("malformed tarsum: %w", err)
+			}
+			continue
+		}
+
+		fields := strings.Split(line, "\t")
+		if len(fields) != 4 {
+			return nil, "", nil, nil, fmt.Errorf("malformed manifest entry: %q", line)
+		}
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, "", nil, nil, fmt.Errorf("malformed size in entry %q: %w", line, err)
+		}
+		mtime, err := time.Parse(time.RFC3339, fields[2])
+		if err != nil {
+			return nil, "", nil, nil, fmt.Errorf("malformed mtime in entry %q: %w", line, err)
+		}
+		entries = append(entries, ManifestEntry{Path: fields[0], Size: size, MTime: mtime, Hash: fields[3]})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, "", nil, nil, err
+	}
+	if fileHashAlgo == "" {
+		return nil, "", nil, nil, fmt.Errorf("manifest is missing its HASH header line")
+	}
+	return entries, fileHashAlgo, archiveHash, contentHash, nil
+}
+
+// verifyManifest re-hashes every file recorded in the manifest directly
+// from the zip archive and reports which entries, if any, no longer
+// match. Hashing each member individually lets corruption be localized
+// to the offending file instead of just failing verification outright.
+func verifyManifest(archive, manifestFile string, hmacKey []byte, password string) ([]Mismatch, error) {
+	entries, fileHashAlgo, _, _, err := readManifest(manifestFile)
+	if err != nil {
+		return nil, err
+	}
+
+	zipReader, err := zip.OpenReader(archive)
+	if err != nil {
+		return nil, err
+	}
+	defer zipReader.Close()
+
+	byName := make(map[string]*zip.File, len(zipReader.File))
+	for _, f := range zipReader.File {
+		byName[f.Name] = f
+	}
+
+	var mismatches []Mismatch
+	for _, e := range entries {
+		f, ok := byName[e.Path]
+		if !ok {
+			mismatches = append(mismatches, Mismatch{Path: e.Path, Reason: "missing from archive"})
+			continue
+		}
+
+		var hasher hash.Hash
+		if strings.EqualFold(fileHashAlgo, tarsumAlgoName) {
+			hasher = newTarEntryHasher(e.Path, f.Mode(), e.Size)
+		} else {
+			hasher, err = resolveHasher(fileHashAlgo, hmacKey)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		rc, err := openEntry(f, password)
+		if err != nil {
+			mismatches = append(mismatches, Mismatch{Path: e.Path, Reason: fmt.Sprintf("could not open: %v", err)})
+			continue
+		}
+		_, err = io.Copy(hasher, rc)
+		rc.Close()
+		if err != nil {
+			mismatches = append(mismatches, Mismatch{Path: e.Path, Reason: fmt.Sprintf("could not read: %v", err)})
+			continue
+		}
+
+		if got := fmt.Sprintf("%x", hasher.Sum(nil)); got != e.Hash {
+			mismatches = append(mismatches, Mismatch{Path: e.Path, Reason: fmt.Sprintf("hash mismatch: expected %s, got %s", e.Hash, got)})
+		}
+	}
+
+	return mismatches, nil
+}
+
+// signManifest produces a detached ASCII-armored signature for the
+// manifest using a PGP private key, in the same spirit as deb-simple's
+// apt.go release signing.
+func signManifest(manifestFile, keyFile string) error {
+	keyRing, err := loadKeyRing(keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load signing key: %w", err)
+	}
+	if len(keyRing) == 0 {
+		return fmt.Errorf("no key found in %s", keyFile)
+	}
+
+	manifest, err := os.Open(manifestFile)
+	if err != nil {
+		return err
+	}
+	defer manifest.Close()
+
+	sigFile, err := os.Create(manifestFile + manifestSigExt)
+	if err != nil {
+		return err
+	}
+	defer sigFile.Close()
+
+	armored, err := armor.Encode(sigFile, openpgp.SignatureType, nil)
+	if err != nil {
+		return err
+	}
+	if err := openpgp.DetachSign(armored, keyRing[0], manifest, nil); err != nil {
+		return fmt.Errorf("failed to sign manifest: %w", err)
+	}
+	return armored.Close()
+}
+
+// verifyManifestSignature checks the detached MANIFEST.asc signature
+// against the manifest using a PGP public keyring. This runs before any
+// member files are re-hashed, so a tampered manifest is caught up front.
+func verifyManifestSignature(manifestFile, keyFile string) error {
+	keyRing, err := loadKeyRing(keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load verification key: %w", err)
+	}
+
+	sigFile, err := os.Open(manifestFile + manifestSigExt)
+	if err != nil {
+		return fmt.Errorf("could not open manifest signature: %w", err)
+	}
+	defer sigFile.Close()
+
+	block, err := armor.Decode(sigFile)
+	if err != nil {
+		return fmt.Errorf("could not decode manifest signature: %w", err)
+	}
+
+	manifest, err := os.Open(manifestFile)
+	if err != nil {
+		return err
+	}
+	defer manifest.Close()
+
+	if _, err := openpgp.CheckDetachedSignature(keyRing, manifest, block.Body); err != nil {
+		return fmt.Errorf("manifest signature verification failed: %w", err)
+	}
+	return nil
+}
+
+// loadKeyRing reads a PGP keyfile, trying the armored format first and
+// falling back to binary.
+func loadKeyRing(keyFile string) (openpgp.EntityList, error) {
+	f, err := os.Open(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	keyRing, err := openpgp.ReadArmoredKeyRing(f)
+	if err == nil {
+		return keyRing, nil
+	}
+
+	if _, seekErr := f.Seek(0, io.SeekStart); seekErr != nil {
+		return nil, err
+	}
+	return openpgp.ReadKeyRing(f)
+}
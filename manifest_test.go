@@ -0,0 +1,129 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeTestTree creates a couple of files under a temp directory and
+// archives them with the given hash algorithm and HMAC key, returning
+// the archive path, manifest path, and the Archiver used.
+func writeTestTree(t *testing.T, hashAlgo string, hmacKey []byte) (archive, manifest string) {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "b.txt"), []byte("world"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	archiver, err := NewArchiver(hashAlgo, hmacKey, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	archive = filepath.Join(t.TempDir(), "out.zip")
+	entries, err := archiver.Archive(dir, archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fileLabel := hashAlgo
+	if hashAlgo != tarsumAlgoName {
+		fileLabel = hashLabel(hashAlgo, hmacKey)
+	}
+
+	manifest = filepath.Join(t.TempDir(), "MANIFEST")
+	if err := writeManifest(manifest, fileLabel, archiver.archiveHashLabel(), entries, archiver.ArchiveHash(), archiver.ContentHash()); err != nil {
+		t.Fatal(err)
+	}
+	return archive, manifest
+}
+
+func TestWriteReadManifestRoundTrip(t *testing.T) {
+	archive, manifest := writeTestTree(t, "sha256", nil)
+
+	entries, fileHashAlgo, archiveHash, contentHash, err := readManifest(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fileHashAlgo != "SHA256" {
+		t.Fatalf("fileHashAlgo = %q, want SHA256", fileHashAlgo)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("got %d entries, want 2", len(entries))
+	}
+	if len(archiveHash) == 0 || len(contentHash) == 0 {
+		t.Fatal("expected both archiveHash and contentHash to be populated")
+	}
+
+	mismatches, err := verifyManifest(archive, manifest, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mismatches) != 0 {
+		t.Fatalf("unexpected mismatches: %v", mismatches)
+	}
+}
+
+// TestVerifyManifestHMAC is a regression test for a bug where the HASH
+// line was written without its hmac- prefix, causing -verify to rehash
+// with the plain (unkeyed) algorithm and report every file as corrupt.
+func TestVerifyManifestHMAC(t *testing.T) {
+	key := []byte("secret")
+	archive, manifest := writeTestTree(t, "sha256", key)
+
+	_, fileHashAlgo, _, _, err := readManifest(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fileHashAlgo != "HMAC-SHA256" {
+		t.Fatalf("fileHashAlgo = %q, want HMAC-SHA256", fileHashAlgo)
+	}
+
+	mismatches, err := verifyManifest(archive, manifest, key, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mismatches) != 0 {
+		t.Fatalf("unexpected mismatches against an intact HMAC-keyed archive: %v", mismatches)
+	}
+}
+
+// TestVerifyManifestCaseInsensitive is a regression test for a bug where
+// the uppercased HASH/ARCHIVE labels written to the MANIFEST didn't
+// round-trip through the (lowercase-only) hasher registry.
+func TestVerifyManifestCaseInsensitive(t *testing.T) {
+	archive, manifest := writeTestTree(t, "blake2b", nil)
+
+	mismatches, err := verifyManifest(archive, manifest, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mismatches) != 0 {
+		t.Fatalf("unexpected mismatches: %v", mismatches)
+	}
+}
+
+func TestVerifyManifestDetectsCorruption(t *testing.T) {
+	archive, manifest := writeTestTree(t, "sha256", nil)
+
+	entries, fileHashAlgo, archiveHash, contentHash, err := readManifest(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries[0].Hash = "0000000000000000000000000000000000000000000000000000000000000000"
+	if err := writeManifest(manifest, fileHashAlgo, "SHA256", entries, archiveHash, contentHash); err != nil {
+		t.Fatal(err)
+	}
+
+	mismatches, err := verifyManifest(archive, manifest, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mismatches) != 1 {
+		t.Fatalf("got %d mismatches, want 1", len(mismatches))
+	}
+}
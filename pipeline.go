@@ -0,0 +1,346 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// rawDeflateBuffer accumulates a single zip member's deflated bytes in
+// memory so a worker can hand it to the serializer goroutine, which
+// writes it into the zip with zip.Writer.CreateRaw without having to
+// recompress it.
+type rawDeflateBuffer struct {
+	bytes.Buffer
+}
+
+func (b *rawDeflateBuffer) writer() (*flate.Writer, error) {
+	return flate.NewWriter(&b.Buffer, flate.DefaultCompression)
+}
+
+// Archiver builds a zip archive using a producer/consumer pipeline: one
+// goroutine walks the directory and discovers files, a pool of workers
+// compresses and hashes each file independently, and a single
+// serializer goroutine writes finished entries into the zip in
+// deterministic (sorted) order. This replaces the old single-goroutine
+// walk-then-reread approach so large trees scale with -j.
+type Archiver struct {
+	hashAlgo string
+	hmacKey  []byte
+	workers  int
+
+	archiveHash hash.Hash
+	contentHash *TarSum
+
+	encryptSpec *aesKeySpec
+	password    string
+}
+
+// ContentHash returns the tarsum-style content hash accumulated while
+// Archive wrote the zip file. It's tracked alongside the regular
+// archive-wide hash regardless of which -hash algorithm was selected,
+// so a MANIFEST always lets a consumer verify either invariant.
+func (a *Archiver) ContentHash() []byte {
+	return a.contentHash.Sum()
+}
+
+// archiveHashLabel names the algorithm backing ArchiveHash. tarsum is a
+// content hash, not a byte-stream one, so when it's selected the
+// physical archive bytes still fall back to a plain sha256 digest.
+func (a *Archiver) archiveHashLabel() string {
+	if a.hashAlgo == tarsumAlgoName {
+		return "sha256"
+	}
+	return hashLabel(a.hashAlgo, a.hmacKey)
+}
+
+// WithEncryption turns on per-entry WinZip AE-2 encryption for
+// subsequent Archive/archiveJobs calls, using algo ("aes128", "aes192"
+// or "aes256") and the given passphrase.
+func (a *Archiver) WithEncryption(algo, password string) error {
+	spec, err := aesSpecByName(algo)
+	if err != nil {
+		return err
+	}
+	a.encryptSpec = &spec
+	a.password = password
+	return nil
+}
+
+// NewArchiver prepares an Archiver that hashes file contents with
+// hashAlgo (optionally HMAC-keyed via hmacKey) using workers concurrent
+// compression/hashing goroutines. workers is clamped to at least 1.
+func NewArchiver(hashAlgo string, hmacKey []byte, workers int) (*Archiver, error) {
+	if workers < 1 {
+		workers = 1
+	}
+
+	var archiveHash hash.Hash
+	var err error
+	if hashAlgo == tarsumAlgoName {
+		archiveHash, err = getHasher("sha256")
+	} else {
+		archiveHash, err = newHasher(hashAlgo, hmacKey)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &Archiver{
+		hashAlgo:    hashAlgo,
+		hmacKey:     hmacKey,
+		workers:     workers,
+		archiveHash: archiveHash,
+		contentHash: NewTarSum(),
+	}, nil
+}
+
+// ArchiveHash returns the archive-wide hash accumulated while Archive
+// wrote the zip file, with no separate re-read pass required.
+func (a *Archiver) ArchiveHash() []byte {
+	return a.archiveHash.Sum(nil)
+}
+
+// fileJob is a single file discovered by the walker, queued for a
+// worker to read, compress and hash.
+type fileJob struct {
+	index   int
+	relPath string
+	absPath string
+	info    os.FileInfo
+}
+
+// compiledEntry is a worker's finished output: a raw-deflated zip
+// member plus its manifest metadata, held until the serializer is ready
+// to write it in sorted order.
+type compiledEntry struct {
+	job        fileJob
+	header     *zip.FileHeader
+	compressed []byte
+	entry      ManifestEntry
+	err        error
+}
+
+// Archive walks dir, compresses and hashes its files across a.workers
+// goroutines, and writes them into output in deterministic path order.
+func (a *Archiver) Archive(dir, output string) ([]ManifestEntry, error) {
+	jobs, err := discoverFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	return a.archiveJobs(jobs, output)
+}
+
+// archiveJobs writes a fixed, already-sorted set of jobs into output. It
+// underlies both Archive (the full tree) and the incremental archiver
+// (just the changed subset).
+func (a *Archiver) archiveJobs(jobs []fileJob, output string) ([]ManifestEntry, error) {
+	jobs = reindexJobs(jobs)
+
+	zipFile, err := os.Create(output)
+	if err != nil {
+		return nil, err
+	}
+	defer zipFile.Close()
+
+	// Feed every byte written to the zip through the archive-wide
+	// hasher as it's written, instead of seeking back and rereading
+	// the finished file.
+	zipWriter := zip.NewWriter(io.MultiWriter(zipFile, a.archiveHash))
+
+	jobCh := make(chan fileJob, len(jobs))
+	resultCh := make(chan compiledEntry, len(jobs))
+
+	for _, j := range jobs {
+		jobCh <- j
+	}
+	close(jobCh)
+
+	workers := a.workers
+	if workers > len(jobs) && len(jobs) > 0 {
+		workers = len(jobs)
+	}
+	for i := 0; i < workers; i++ {
+		go a.compressWorker(jobCh, resultCh)
+	}
+
+	entries, err := serializeEntries(zipWriter, resultCh, len(jobs))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := zipWriter.Close(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// discoverFiles walks dir once up front and returns every regular file
+// in deterministic (sorted by archive path) order, so workers can be
+// dispatched against a fixed, reproducible job list.
+func discoverFiles(dir string) ([]fileJob, error) {
+	var jobs []fileJob
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		relPath, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		jobs = append(jobs, fileJob{relPath: relPath, absPath: path, info: info})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].relPath < jobs[j].relPath })
+	return reindexJobs(jobs), nil
+}
+
+// reindexJobs assigns sequential indices to an already-sorted job list,
+// so a filtered subset (e.g. only the changed files for an incremental
+// archive) can still be serialized in deterministic order.
+func reindexJobs(jobs []fileJob) []fileJob {
+	for i := range jobs {
+		jobs[i].index = i
+	}
+	return jobs
+}
+
+// compressWorker reads and deflates a file into memory and computes its
+// manifest hash, independently of every other worker.
+func (a *Archiver) compressWorker(jobs <-chan fileJob, results chan<- compiledEntry) {
+	for job := range jobs {
+		entry, err := a.compressFile(job)
+		if err != nil {
+			results <- compiledEntry{job: job, err: err}
+			continue
+		}
+		results <- entry
+	}
+}
+
+func (a *Archiver) compressFile(job fileJob) (compiledEntry, error) {
+	file, err := os.Open(job.absPath)
+	if err != nil {
+		return compiledEntry{}, err
+	}
+	defer file.Close()
+
+	// Every entry always contributes to the content-addressable tarsum,
+	// regardless of which -hash algorithm the manifest's per-file hash
+	// uses; when tarsum *is* that algorithm, it's the same hasher.
+	tarHasher := newTarEntryHasher(job.relPath, job.info.Mode(), job.info.Size())
+
+	var fileHasher hash.Hash
+	if a.hashAlgo == tarsumAlgoName {
+		fileHasher = tarHasher
+	} else {
+		fileHasher, err = newHasher(a.hashAlgo, a.hmacKey)
+		if err != nil {
+			return compiledEntry{}, err
+		}
+	}
+	crc := crc32.NewIEEE()
+
+	var compressed rawDeflateBuffer
+	flateWriter, err := compressed.writer()
+	if err != nil {
+		return compiledEntry{}, err
+	}
+
+	writers := []io.Writer{flateWriter, crc, fileHasher}
+	if fileHasher != tarHasher {
+		writers = append(writers, tarHasher)
+	}
+	if _, err := io.Copy(io.MultiWriter(writers...), file); err != nil {
+		return compiledEntry{}, err
+	}
+	if err := flateWriter.Close(); err != nil {
+		return compiledEntry{}, err
+	}
+	a.contentHash.addDigest(tarHasher.Sum(nil))
+
+	header, err := zip.FileInfoHeader(job.info)
+	if err != nil {
+		return compiledEntry{}, err
+	}
+	header.Name = job.relPath
+	header.Method = zip.Deflate
+	header.CRC32 = crc.Sum32()
+	header.UncompressedSize64 = uint64(job.info.Size())
+
+	payload := compressed.Bytes()
+	if a.encryptSpec != nil {
+		encrypted, err := encryptEntry(*a.encryptSpec, a.password, payload)
+		if err != nil {
+			return compiledEntry{}, err
+		}
+		payload = encrypted
+		header.Method = aeMethod
+		header.Extra = aeExtraField(*a.encryptSpec, zip.Deflate)
+		header.CRC32 = 0 // AE-2: integrity is the HMAC tag, not a stored plaintext CRC
+	}
+	header.CompressedSize64 = uint64(len(payload))
+
+	return compiledEntry{
+		job:        job,
+		header:     header,
+		compressed: payload,
+		entry: ManifestEntry{
+			Path:  job.relPath,
+			Size:  job.info.Size(),
+			MTime: job.info.ModTime(),
+			Hash:  fmt.Sprintf("%x", fileHasher.Sum(nil)),
+		},
+	}, nil
+}
+
+// serializeEntries collects the total compiled entries from results and
+// writes them into zipWriter strictly in job-index (i.e. sorted path)
+// order, regardless of the order workers finish in. This is what makes
+// the resulting archive byte-for-byte reproducible across runs.
+func serializeEntries(zipWriter *zip.Writer, results <-chan compiledEntry, total int) ([]ManifestEntry, error) {
+	pending := make(map[int]compiledEntry, total)
+	entries := make([]ManifestEntry, 0, total)
+	next := 0
+
+	for received := 0; received < total; received++ {
+		result := <-results
+		if result.err != nil {
+			return nil, result.err
+		}
+		pending[result.job.index] = result
+
+		for {
+			ready, ok := pending[next]
+			if !ok {
+				break
+			}
+			writer, err := zipWriter.CreateRaw(ready.header)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := writer.Write(ready.compressed); err != nil {
+				return nil, err
+			}
+			entries = append(entries, ready.entry)
+			delete(pending, next)
+			next++
+		}
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// benchTree creates n small files under a temp directory and returns its
+// path, for comparing single-worker vs fully parallel archiving.
+func benchTree(b *testing.B, n int) string {
+	b.Helper()
+	dir := b.TempDir()
+	payload := make([]byte, 32*1024)
+	for i := 0; i < n; i++ {
+		path := filepath.Join(dir, fmt.Sprintf("file-%04d.bin", i))
+		if err := os.WriteFile(path, payload, 0644); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func benchmarkArchive(b *testing.B, workers int) {
+	dir := benchTree(b, 500)
+	out := filepath.Join(b.TempDir(), "archive.zip")
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		archiver, err := NewArchiver("sha256", nil, workers)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := archiver.Archive(dir, out); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkArchiveSingleWorker(b *testing.B) {
+	benchmarkArchive(b, 1)
+}
+
+func BenchmarkArchiveAllCPUs(b *testing.B) {
+	benchmarkArchive(b, runtime.NumCPU())
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+	"os"
+	"sync"
+)
+
+// tarsumAlgoName is the -hash value that selects content-addressable
+// hashing instead of a plain byte-stream digest.
+const tarsumAlgoName = "tarsum"
+
+// TarSum accumulates a deterministic content hash over archive members,
+// independent of their compression, physical ordering, or timestamps —
+// the same logical tree produces the same tarsum no matter how it was
+// zipped. Each entry's per-file digest (see newTarEntryHasher) is
+// XOR-combined into the running total, so entries may be folded in
+// from concurrent workers in any order.
+type TarSum struct {
+	mu  sync.Mutex
+	acc [sha256.Size]byte
+}
+
+// NewTarSum returns an empty accumulator.
+func NewTarSum() *TarSum {
+	return &TarSum{}
+}
+
+// addDigest XORs one entry's already-computed digest into the running
+// total.
+func (t *TarSum) addDigest(digest []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := 0; i < len(digest) && i < len(t.acc); i++ {
+		t.acc[i] ^= digest[i]
+	}
+}
+
+// Sum returns the accumulated content hash.
+func (t *TarSum) Sum() []byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make([]byte, len(t.acc))
+	copy(out, t.acc[:])
+	return out
+}
+
+// newTarEntryHasher returns a hash.Hash pre-seeded with a canonicalized
+// header (name, permission bits, size) for one archive member; the
+// caller writes the member's raw (uncompressed) bytes into it exactly
+// as it would any other hasher, and its Sum is that entry's tarsum
+// digest.
+func newTarEntryHasher(name string, mode os.FileMode, size int64) hash.Hash {
+	h := sha256.New()
+	h.Write(canonicalTarHeader(name, mode, size))
+	return h
+}
+
+// canonicalTarHeader encodes the parts of a file's identity that two
+// archives of the same logical tree always agree on, deliberately
+// omitting anything compression or timestamp related.
+func canonicalTarHeader(name string, mode os.FileMode, size int64) []byte {
+	buf := make([]byte, 0, len(name)+13)
+	buf = append(buf, []byte(name)...)
+	buf = append(buf, 0)
+
+	var sizeBuf [8]byte
+	binary.BigEndian.PutUint64(sizeBuf[:], uint64(size))
+	buf = append(buf, sizeBuf[:]...)
+
+	var modeBuf [4]byte
+	binary.BigEndian.PutUint32(modeBuf[:], uint32(mode.Perm()))
+	buf = append(buf, modeBuf[:]...)
+
+	return buf
+}
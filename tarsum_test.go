@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func archiveTarsum(t *testing.T, dir string) []byte {
+	t.Helper()
+	archiver, err := NewArchiver(tarsumAlgoName, nil, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(t.TempDir(), "out.zip")
+	if _, err := archiver.Archive(dir, out); err != nil {
+		t.Fatal(err)
+	}
+	return archiver.ContentHash()
+}
+
+func TestTarSumIndependentOfWorkerCount(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("payload-"+name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	single, err := NewArchiver(tarsumAlgoName, nil, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outSingle := filepath.Join(t.TempDir(), "single.zip")
+	if _, err := single.Archive(dir, outSingle); err != nil {
+		t.Fatal(err)
+	}
+
+	parallel, err := NewArchiver(tarsumAlgoName, nil, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outParallel := filepath.Join(t.TempDir(), "parallel.zip")
+	if _, err := parallel.Archive(dir, outParallel); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(single.ContentHash(), parallel.ContentHash()) {
+		t.Fatal("tarsum differed between a single worker and four workers over the same tree")
+	}
+}
+
+func TestTarSumChangesWithContent(t *testing.T) {
+	dirA := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dirA, "a.txt"), []byte("one"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dirB := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dirB, "a.txt"), []byte("two"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Equal(archiveTarsum(t, dirA), archiveTarsum(t, dirB)) {
+		t.Fatal("expected different tarsums for different file contents")
+	}
+}